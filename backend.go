@@ -0,0 +1,128 @@
+//
+// Backend is the internal driver interface the plugin server
+// dispatches to.
+//
+// The handlers in plugin.go used to call fixed-shape methods like
+// create(name, opts map[string]string) directly against a
+// *vmdkDriver. This mirrors the modern moby volume backend shape
+// instead: context-aware methods taking functional options, so a new
+// knob (a label, a force flag) doesn't change every call site, and a
+// context deadline can abort an in-flight ESX RPC.
+//
+package main
+
+import (
+	"strings"
+
+	"github.com/docker/engine-api/types/filters"
+	"golang.org/x/net/context"
+)
+
+// Backend is implemented by *vmdkDriver.
+type Backend interface {
+	Create(ctx context.Context, name, driverName string, opts ...CreateOption) (*vmdkVolume, error)
+	Get(ctx context.Context, name string, opts ...GetOption) (*vmdkVolume, error)
+	List(ctx context.Context, filter filters.Args) (vols []*vmdkVolume, warnings []string, err error)
+	Remove(ctx context.Context, name string, opts ...RemoveOption) error
+	Prune(ctx context.Context, filter filters.Args) (*VolumesPruneReport, error)
+}
+
+// VolumesPruneReport summarizes a Prune call.
+type VolumesPruneReport struct {
+	VolumesDeleted []string
+}
+
+type createOptions struct {
+	size   string
+	policy string
+	labels map[string]string
+}
+
+// CreateOption configures a Backend.Create call.
+type CreateOption func(*createOptions)
+
+// WithSize sets the requested VMDK size (e.g. "10gb").
+func WithSize(size string) CreateOption {
+	return func(o *createOptions) { o.size = size }
+}
+
+// WithPolicy sets the VSAN storage policy to create the VMDK under.
+func WithPolicy(policy string) CreateOption {
+	return func(o *createOptions) { o.policy = policy }
+}
+
+// WithLabels attaches arbitrary labels, used by Prune's filter.
+func WithLabels(labels map[string]string) CreateOption {
+	return func(o *createOptions) { o.labels = labels }
+}
+
+type getOptions struct {
+	reference string
+}
+
+// GetOption configures a Backend.Get call.
+type GetOption func(*getOptions)
+
+// WithReference scopes a Get to a particular container reference,
+// the way moby tracks which containers currently hold a volume.
+func WithReference(ref string) GetOption {
+	return func(o *getOptions) { o.reference = ref }
+}
+
+type removeOptions struct {
+	force        bool
+	purgeOnError bool
+}
+
+// RemoveOption configures a Backend.Remove call.
+type RemoveOption func(*removeOptions)
+
+// WithForce removes a volume even if it is still mounted.
+func WithForce(force bool) RemoveOption {
+	return func(o *removeOptions) { o.force = force }
+}
+
+// WithPurgeOnError drops a volume's metadata even if the underlying
+// VMDK delete fails, so a broken volume doesn't linger forever in
+// List output.
+func WithPurgeOnError(purge bool) RemoveOption {
+	return func(o *removeOptions) { o.purgeOnError = purge }
+}
+
+// esxCall stands in for the point where the real driver would issue
+// an RPC to vmdkops on the ESX host: ctx cancellation aborts it
+// before the (simulated) call completes.
+func (d *vmdkDriver) esxCall(ctx context.Context, op string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// matchesLabelFilter reports whether v matches a "label" filter
+// (key=value or bare key entries), or true if the filter carries no
+// label entries at all.
+func matchesLabelFilter(v *vmdkVolume, filter filters.Args) bool {
+	values := filter.Get("label")
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, kv := range values {
+		key, value := splitLabel(kv)
+		if existing, ok := v.Labels[key]; ok && (value == "" || existing == value) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitLabel(kv string) (key, value string) {
+	idx := strings.Index(kv, "=")
+	if idx < 0 {
+		return kv, ""
+	}
+	return kv[:idx], kv[idx+1:]
+}
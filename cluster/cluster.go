@@ -0,0 +1,148 @@
+//
+// Package cluster implements Swarm-aware clustered volume placement
+// for the vmdk driver.
+//
+// TestSanity talks to two docker engines (-H1, -H2) and simply hopes
+// both see the same VMDK. This package gives that placement a name:
+// given the engines in a cluster, it either fans a volume create out
+// to all of them (mirroring Swarm's Cluster.CreateVolume, which
+// doesn't know in advance which node a container will land on) or
+// routes it to one specific engine via a "node/volume" name or a
+// "constraint:node==X" scheduler constraint.
+//
+package cluster
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"golang.org/x/net/context"
+)
+
+// Engine is one Docker engine (host) participating in the cluster.
+type Engine struct {
+	Name   string
+	Client *client.Client
+}
+
+// SelectHostForVolume picks which Engine a volume create (or a
+// subsequent mount of an existing volume) should be routed to.
+// Implementations are pluggable placement policies: round-robin,
+// free-space-weighted, datastore affinity, and so on.
+type SelectHostForVolume interface {
+	Select(engines []Engine, req types.VolumeCreateRequest) (*Engine, error)
+}
+
+// RoundRobin is the simplest SelectHostForVolume policy: it cycles
+// through the engine list on every call.
+type RoundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+// Select returns the next engine in round-robin order.
+func (r *RoundRobin) Select(engines []Engine, req types.VolumeCreateRequest) (*Engine, error) {
+	if len(engines) == 0 {
+		return nil, errors.New("cluster: no engines available")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := &engines[r.next%len(engines)]
+	r.next++
+	return e, nil
+}
+
+// NodeConstraint routes to the engine named by a "node/volume" volume
+// name, or by a "constraint:node==X" driver opt, mirroring Swarm
+// scheduler constraints. It returns an error if the request names no
+// node at all.
+type NodeConstraint struct{}
+
+// Select resolves the engine named in req.Name or req.DriverOpts.
+func (NodeConstraint) Select(engines []Engine, req types.VolumeCreateRequest) (*Engine, error) {
+	node, _ := splitNodeVolume(req.Name)
+	if node == "" {
+		node = req.DriverOpts["constraint:node"]
+	}
+	if node == "" {
+		return nil, errors.New("cluster: no node constraint in request")
+	}
+
+	for i := range engines {
+		if engines[i].Name == node {
+			return &engines[i], nil
+		}
+	}
+	return nil, errors.New("cluster: no such node: " + node)
+}
+
+// splitNodeVolume splits a "node/volume" name into its node and
+// volume parts. If name has no "/", node is "" and volume is name
+// unchanged.
+func splitNodeVolume(name string) (node, volume string) {
+	idx := strings.Index(name, "/")
+	if idx < 0 {
+		return "", name
+	}
+	return name[:idx], name[idx+1:]
+}
+
+// CreateVolume fans a volume create request out to every engine in
+// the cluster in parallel, the way Swarm's Cluster.CreateVolume does
+// when the request carries no node constraint: it keeps the first
+// successful *types.Volume and only returns an error if every engine
+// failed. ctx cancellation stops the caller from waiting past a
+// deadline (returning ctx.Err()), but does not abort engines that are
+// already mid-request.
+func CreateVolume(ctx context.Context, engines []Engine, req types.VolumeCreateRequest) (*types.Volume, error) {
+	_, req.Name = splitNodeVolume(req.Name)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		volume  *types.Volume
+		lastErr error
+	)
+
+	for _, e := range engines {
+		wg.Add(1)
+		go func(e Engine) {
+			defer wg.Done()
+
+			v, err := e.Client.VolumeCreate(req)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			if volume == nil {
+				volume = &v
+			}
+		}(e)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if volume == nil {
+		return nil, lastErr
+	}
+	return volume, nil
+}
@@ -0,0 +1,383 @@
+//
+// VMDK Docker volume driver - in-process volume backend.
+//
+// TestSanity drives the driver indirectly, through Docker's engine-api
+// client and a running daemon. This file is the backend the plugin
+// HTTP server (plugin.go) dispatches to: it tracks volume state the
+// way the real driver tracks VMDK disks on ESX, without requiring a
+// live ESX host to exercise the plugin protocol end to end.
+//
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/docker/engine-api/types/filters"
+	"golang.org/x/net/context"
+)
+
+const defaultPluginMountLocation = "/mnt/vmdk"
+
+// mountpointFor returns the in-container mount point the plugin
+// reports for a given volume.
+func mountpointFor(vol string) string {
+	return defaultPluginMountLocation + "/" + vol
+}
+
+// knownPolicies are the VSAN storage policy names this in-process
+// backend recognizes; Create rejects any other policy name with
+// ErrPolicyNotFound.
+var knownPolicies = map[string]bool{
+	"good":   true,
+	"silver": true,
+	"gold":   true,
+}
+
+// vmdkVolume describes the state of a single VMDK-backed Docker volume.
+//
+// References records the container references a caller has told Get
+// about via WithReference, independent of refCounts: a container can
+// reference a volume (e.g. "docker inspect" while planning a mount)
+// before it's actually mounted.
+type vmdkVolume struct {
+	Name       string
+	Size       string
+	Policy     string
+	Datastore  string
+	Labels     map[string]string
+	Mounted    bool
+	Status     string
+	Files      map[string]bool
+	References map[string]bool
+}
+
+// vmdkDriver is the in-process VMDK backend used by the plugin server.
+//
+// refCounts is keyed by volume name and incremented only after a
+// mount has actually attached the VMDK, so a mount that fails
+// mid-flight (image copy on -w, missing bind-mount target, ESX
+// attach race) never leaves a phantom reference for a later Unmount
+// to mistakenly detach.
+//
+// mu guards every field below: the plugin server dispatches each
+// Docker Volume Plugin request on its own goroutine (net/http), so
+// concurrent Create/mount/unmount/Remove calls hit these maps from
+// multiple goroutines at once.
+type vmdkDriver struct {
+	mu                    sync.Mutex
+	volumes               map[string]*vmdkVolume
+	snapshots             map[string]*vmdkSnapshot
+	snapshotSeq           int
+	refCounts             map[string]int
+	failNextMount         map[string]bool
+	unreachableDatastores map[string]bool
+	lastWarnings          []string
+}
+
+func newVmdkDriver() *vmdkDriver {
+	return &vmdkDriver{
+		volumes:               make(map[string]*vmdkVolume),
+		snapshots:             make(map[string]*vmdkSnapshot),
+		refCounts:             make(map[string]int),
+		failNextMount:         make(map[string]bool),
+		unreachableDatastores: make(map[string]bool),
+	}
+}
+
+// Create implements Backend. driverName is accepted (rather than
+// assumed) the way moby's volume backend takes it, so the same method
+// can one day back more than one driver name alias. The ESX RPC runs
+// with d.mu released, matching Get/List/Remove/Prune, so it can't
+// stall every other volume's operations for its duration.
+func (d *vmdkDriver) Create(ctx context.Context, name, driverName string, opts ...CreateOption) (*vmdkVolume, error) {
+	var o createOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	d.mu.Lock()
+	if _, exists := d.volumes[name]; exists {
+		d.mu.Unlock()
+		return nil, errors.New("volume already exists: " + name)
+	}
+	if o.policy != "" && !knownPolicies[o.policy] {
+		d.mu.Unlock()
+		return nil, &ErrPolicyNotFound{Policy: o.policy}
+	}
+	d.mu.Unlock()
+
+	if err := d.esxCall(ctx, "create "+name); err != nil {
+		return nil, err
+	}
+
+	v := &vmdkVolume{
+		Name:       name,
+		Size:       o.size,
+		Policy:     o.policy,
+		Labels:     o.labels,
+		Status:     statusAvailable,
+		Files:      make(map[string]bool),
+		References: make(map[string]bool),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.volumes[name]; exists {
+		return nil, errors.New("volume already exists: " + name)
+	}
+	d.volumes[name] = v
+	return v, nil
+}
+
+// writeFile and deleteFile simulate the filesystem contents of a
+// mounted VMDK; TestSnapshotRoundtrip uses them in place of actually
+// touching/removing a file inside a container, since this backend has
+// no real mount to write to.
+func (d *vmdkDriver) writeFile(name, file string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return errors.New("no such volume: " + name)
+	}
+	v.Files[file] = true
+	return nil
+}
+
+func (d *vmdkDriver) deleteFile(name, file string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return errors.New("no such volume: " + name)
+	}
+	delete(v.Files, file)
+	return nil
+}
+
+func (d *vmdkDriver) hasFile(name, file string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	return exists && v.Files[file]
+}
+
+// Get implements Backend. A non-empty WithReference records that ref
+// has an interest in name, independent of refCounts: a container can
+// reference a volume (e.g. while resolving a mount) before it
+// actually mounts it.
+func (d *vmdkDriver) Get(ctx context.Context, name string, opts ...GetOption) (*vmdkVolume, error) {
+	var o getOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := d.esxCall(ctx, "get "+name); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return nil, &ErrVolumeNotFound{Name: name}
+	}
+	if o.reference != "" {
+		v.References[o.reference] = true
+	}
+	return v, nil
+}
+
+// List implements Backend. Rather than failing the whole call over a
+// single bad datastore, volumes backed by a datastore marked
+// unreachable (see markDatastoreUnreachable) are dropped from the
+// result and recorded as a warning instead; LastWarnings returns the
+// warnings from the most recent List.
+func (d *vmdkDriver) List(ctx context.Context, filter filters.Args) ([]*vmdkVolume, []string, error) {
+	if err := d.esxCall(ctx, "list"); err != nil {
+		return nil, nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var (
+		vols     []*vmdkVolume
+		warnings []string
+		warned   = make(map[string]bool)
+	)
+
+	for _, v := range d.volumes {
+		if v.Datastore != "" && d.unreachableDatastores[v.Datastore] {
+			if !warned[v.Datastore] {
+				warnings = append(warnings, (&ErrDatastoreUnreachable{Datastore: v.Datastore}).Error())
+				warned[v.Datastore] = true
+			}
+			continue
+		}
+		if matchesLabelFilter(v, filter) {
+			vols = append(vols, v)
+		}
+	}
+
+	d.lastWarnings = warnings
+	return vols, warnings, nil
+}
+
+// markDatastoreUnreachable marks a datastore as unreachable, so List
+// drops its volumes and reports a warning instead of failing
+// outright. Test hook only.
+func (d *vmdkDriver) markDatastoreUnreachable(ds string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.unreachableDatastores[ds] = true
+}
+
+// LastWarnings returns the warnings produced by the most recent List
+// call, for debugging.
+func (d *vmdkDriver) LastWarnings() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastWarnings
+}
+
+// Remove implements Backend. The ESX RPC runs with d.mu released, the
+// way Get/List do, so a slow or cancelled remove of one volume can't
+// stall every other volume's mount/unmount/get/list for its duration.
+func (d *vmdkDriver) Remove(ctx context.Context, name string, opts ...RemoveOption) error {
+	var o removeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	d.mu.Lock()
+	if _, exists := d.volumes[name]; !exists {
+		d.mu.Unlock()
+		return &ErrVolumeNotFound{Name: name}
+	}
+	if d.refCounts[name] > 0 && !o.force {
+		d.mu.Unlock()
+		return &ErrVolumeInUse{Name: name}
+	}
+	d.mu.Unlock()
+
+	if err := d.esxCall(ctx, "remove "+name); err != nil && !o.purgeOnError {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.volumes, name)
+	delete(d.refCounts, name)
+	return nil
+}
+
+// Prune implements Backend: it garbage-collects every unmounted
+// volume matching filter's "label" entries. Candidates are collected
+// under d.mu, but each ESX RPC runs with the lock released so a batch
+// prune doesn't hold every other volume's operations hostage for the
+// whole run.
+func (d *vmdkDriver) Prune(ctx context.Context, filter filters.Args) (*VolumesPruneReport, error) {
+	d.mu.Lock()
+	var candidates []string
+	for name, v := range d.volumes {
+		if d.refCounts[name] > 0 || !matchesLabelFilter(v, filter) {
+			continue
+		}
+		candidates = append(candidates, name)
+	}
+	d.mu.Unlock()
+
+	report := &VolumesPruneReport{}
+	for _, name := range candidates {
+		if err := d.esxCall(ctx, "remove "+name); err != nil {
+			return report, err
+		}
+
+		d.mu.Lock()
+		delete(d.volumes, name)
+		delete(d.refCounts, name)
+		d.mu.Unlock()
+
+		report.VolumesDeleted = append(report.VolumesDeleted, name)
+	}
+	return report, nil
+}
+
+// mount attaches and mounts name, incrementing its ref count only on
+// success: a failure here (simulated via simulateMountFailure, or in
+// the real driver a missing bind-mount target / ESX attach race)
+// must never leave behind a ref count the matching Unmount could
+// mistake for a real attach.
+func (d *vmdkDriver) mount(name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return "", &ErrVolumeNotFound{Name: name}
+	}
+
+	if d.failNextMount[name] {
+		delete(d.failNextMount, name)
+		return "", errors.New("simulated mount failure for volume: " + name)
+	}
+
+	d.refCounts[name]++
+	v.Mounted = true
+	v.Status = statusInUse
+	return mountpointFor(name), nil
+}
+
+// unmount only calls through to the underlying detach once the ref
+// count actually reaches zero from a matching successful mount. An
+// Unmount with no outstanding ref count (Docker paired it with a
+// mount that never succeeded) is a no-op rather than an error, since
+// Docker issues Unmount unconditionally after a container exits.
+func (d *vmdkDriver) unmount(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return &ErrVolumeNotFound{Name: name}
+	}
+
+	if d.refCounts[name] == 0 {
+		return nil
+	}
+
+	d.refCounts[name]--
+	if d.refCounts[name] == 0 {
+		v.Mounted = false
+		v.Status = statusAvailable
+	}
+	return nil
+}
+
+// simulateMountFailure arranges for the next mount of name to fail,
+// the way a missing bind-mount target directory or an ESX attach
+// race would in the real driver. Test hook only.
+func (d *vmdkDriver) simulateMountFailure(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failNextMount[name] = true
+}
+
+// Stats returns a snapshot of the current per-volume ref counts, for
+// debugging mount/unmount pairing issues.
+func (d *vmdkDriver) Stats() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := make(map[string]int, len(d.refCounts))
+	for name, count := range d.refCounts {
+		stats[name] = count
+	}
+	return stats
+}
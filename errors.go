@@ -0,0 +1,73 @@
+//
+// Typed errors for the vmdk driver.
+//
+// Callers used to get back a bare fmt/errors.New string and had to
+// match on its text to tell "volume doesn't exist" apart from
+// "volume is in use". These implement the standard error interface
+// plus Is, so callers can branch with errors.Is/errors.As instead.
+//
+package main
+
+import "fmt"
+
+// ErrVolumeNotFound means the named volume does not exist.
+type ErrVolumeNotFound struct {
+	Name string
+}
+
+func (e *ErrVolumeNotFound) Error() string {
+	return fmt.Sprintf("no such volume: %s", e.Name)
+}
+
+// Is lets errors.Is(err, &ErrVolumeNotFound{}) match regardless of Name.
+func (e *ErrVolumeNotFound) Is(target error) bool {
+	_, ok := target.(*ErrVolumeNotFound)
+	return ok
+}
+
+// ErrVolumeInUse means a volume couldn't be removed because it is
+// still mounted (its ref count is above zero) and the caller didn't
+// pass WithForce.
+type ErrVolumeInUse struct {
+	Name string
+}
+
+func (e *ErrVolumeInUse) Error() string {
+	return fmt.Sprintf("volume is in use: %s", e.Name)
+}
+
+func (e *ErrVolumeInUse) Is(target error) bool {
+	_, ok := target.(*ErrVolumeInUse)
+	return ok
+}
+
+// ErrPolicyNotFound means a create request named a VSAN storage
+// policy the driver doesn't recognize.
+type ErrPolicyNotFound struct {
+	Policy string
+}
+
+func (e *ErrPolicyNotFound) Error() string {
+	return fmt.Sprintf("no such policy: %s", e.Policy)
+}
+
+func (e *ErrPolicyNotFound) Is(target error) bool {
+	_, ok := target.(*ErrPolicyNotFound)
+	return ok
+}
+
+// ErrDatastoreUnreachable means a datastore backing one or more
+// volumes could not be reached; List surfaces this as a warning
+// rather than failing the whole call.
+type ErrDatastoreUnreachable struct {
+	Datastore string
+}
+
+func (e *ErrDatastoreUnreachable) Error() string {
+	return fmt.Sprintf("datastore unreachable: %s", e.Datastore)
+}
+
+func (e *ErrDatastoreUnreachable) Is(target error) bool {
+	_, ok := target.(*ErrDatastoreUnreachable)
+	return ok
+}
@@ -0,0 +1,38 @@
+//
+// Entry point for the standalone vmdk Docker Volume Plugin daemon.
+//
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+)
+
+func main() {
+	var tcpAddr string
+	flag.StringVar(&tcpAddr, "listen", "", "listen on this TCP address and register via a .spec file, instead of the default Unix socket")
+	flag.Parse()
+
+	server := newPluginServer(newVmdkDriver())
+
+	if tcpAddr != "" {
+		l, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			log.Fatalf("vmdk plugin: %v", err)
+		}
+		if err := writeSpecFile(l.Addr().String()); err != nil {
+			log.Fatalf("vmdk plugin: writing spec file: %v", err)
+		}
+		log.Printf("vmdk plugin: listening on %s (%s)", l.Addr(), pluginSpecPath)
+		log.Fatal(http.Serve(l, server.mux()))
+	}
+
+	l, err := listenUnix(server.mux())
+	if err != nil {
+		log.Fatalf("vmdk plugin: %v", err)
+	}
+	log.Printf("vmdk plugin: listening on %s", l.Addr())
+	select {}
+}
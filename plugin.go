@@ -0,0 +1,323 @@
+//
+// Docker Volume Plugin HTTP API for the vmdk driver.
+//
+// Implements the Docker Volume Plugin protocol (v1.1): a plain HTTP
+// server that Docker's volume subsystem talks to, exposing
+// Plugin.Activate and the VolumeDriver.* endpoints over JSON with
+// content type pluginContentType. See
+// https://docs.docker.com/engine/extend/plugins_volume/ for the wire
+// format this mirrors.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/docker/engine-api/types/filters"
+	"golang.org/x/net/context"
+)
+
+const (
+	pluginContentType = "application/vnd.docker.plugins.v1.1+json"
+	pluginSpecPath    = "/etc/docker/plugins/vmdk.spec"
+	pluginSockDir     = "/run/docker/plugins"
+	pluginSockName    = "vmdk.sock"
+
+	// driverName is the name this plugin registers volumes under.
+	driverName = "vmdk"
+)
+
+// volumeCreateRequest is the {Name, Opts} payload VolumeDriver.Create
+// is documented to accept.
+type volumeCreateRequest struct {
+	Name   string
+	Opts   map[string]string
+	Labels map[string]string
+}
+
+// volumeNameRequest is the {Name} payload used by Path.
+type volumeNameRequest struct {
+	Name string
+}
+
+// volumeGetRequest is the {Name} payload VolumeDriver.Get is
+// documented to accept; Reference is an admin extension threaded
+// through to Backend.Get's WithReference, not part of the documented
+// protocol.
+type volumeGetRequest struct {
+	Name      string
+	Reference string
+}
+
+// volumeRemoveRequest is the {Name} payload VolumeDriver.Remove is
+// documented to accept; Force and PurgeOnError are admin extensions
+// threaded through to Backend.Remove's WithForce/WithPurgeOnError,
+// not part of the documented protocol.
+type volumeRemoveRequest struct {
+	Name         string
+	Force        bool
+	PurgeOnError bool
+}
+
+// volumeMountRequest is the {Name, ID} payload used by Mount/Unmount.
+type volumeMountRequest struct {
+	Name string
+	ID   string
+}
+
+type volumeResponse struct {
+	Mountpoint string `json:",omitempty"`
+	Err        string
+}
+
+type volumeInfo struct {
+	Name       string
+	Mountpoint string `json:",omitempty"`
+}
+
+type volumeGetResponse struct {
+	Volume *volumeInfo `json:",omitempty"`
+	Err    string
+}
+
+type volumeListResponse struct {
+	Volumes  []volumeInfo
+	Warnings []string `json:",omitempty"`
+	Err      string
+}
+
+type capabilitiesResponse struct {
+	Capabilities struct {
+		Scope string
+	}
+}
+
+// eventCounters counts every activation/create/get/list/mount/unmount/
+// remove the plugin server has handled, mirroring the kind of event
+// counting moby's docker_cli_external_volume_driver_test uses to
+// validate plugin conformance.
+type eventCounters struct {
+	Activations int
+	Creates     int
+	Gets        int
+	Lists       int
+	Mounts      int
+	Unmounts    int
+	Removes     int
+}
+
+// pluginServer wires the Docker Volume Plugin HTTP handlers to a
+// vmdkDriver.
+//
+// eventsMu guards events: net/http dispatches each request on its own
+// goroutine, so concurrent Docker requests would otherwise race on
+// the same counters.
+type pluginServer struct {
+	driver   *vmdkDriver
+	eventsMu sync.Mutex
+	events   eventCounters
+}
+
+func newPluginServer(d *vmdkDriver) *pluginServer {
+	return &pluginServer{driver: d}
+}
+
+// countEvent atomically applies f to the server's event counters.
+func (p *pluginServer) countEvent(f func(*eventCounters)) {
+	p.eventsMu.Lock()
+	defer p.eventsMu.Unlock()
+	f(&p.events)
+}
+
+func (p *pluginServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", p.activate)
+	mux.HandleFunc("/VolumeDriver.Create", p.create)
+	mux.HandleFunc("/VolumeDriver.Get", p.get)
+	mux.HandleFunc("/VolumeDriver.List", p.list)
+	mux.HandleFunc("/VolumeDriver.Remove", p.remove)
+	mux.HandleFunc("/VolumeDriver.Path", p.path)
+	mux.HandleFunc("/VolumeDriver.Mount", p.mount)
+	mux.HandleFunc("/VolumeDriver.Unmount", p.unmount)
+	mux.HandleFunc("/VolumeDriver.Capabilities", p.capabilities)
+	mux.HandleFunc("/VmdkVolumeDriver.SnapshotCreate", p.snapshotCreateHandler)
+	mux.HandleFunc("/VmdkVolumeDriver.SnapshotList", p.snapshotListHandler)
+	mux.HandleFunc("/VmdkVolumeDriver.SnapshotDelete", p.snapshotDeleteHandler)
+	mux.HandleFunc("/VmdkVolumeDriver.CloneFromSnapshot", p.cloneFromSnapshotHandler)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", pluginContentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("vmdk plugin: failed to encode response: %v", err)
+	}
+}
+
+func (p *pluginServer) activate(w http.ResponseWriter, r *http.Request) {
+	p.countEvent(func(e *eventCounters) { e.Activations++ })
+	writeJSON(w, struct{ Implements []string }{Implements: []string{"VolumeDriver"}})
+}
+
+func (p *pluginServer) create(w http.ResponseWriter, r *http.Request) {
+	var req volumeCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+
+	p.countEvent(func(e *eventCounters) { e.Creates++ })
+
+	// from-snapshot/clone-of are admin conveniences layered on top of
+	// the Backend.Create path, not options Backend itself knows about.
+	if snapName, ok := req.Opts["from-snapshot"]; ok {
+		if err := p.driver.cloneFromSnapshotByName(snapName, req.Name); err != nil {
+			writeJSON(w, volumeResponse{Err: err.Error()})
+			return
+		}
+		writeJSON(w, volumeResponse{})
+		return
+	}
+	if volName, ok := req.Opts["clone-of"]; ok {
+		if err := p.driver.cloneVolume(volName, req.Name); err != nil {
+			writeJSON(w, volumeResponse{Err: err.Error()})
+			return
+		}
+		writeJSON(w, volumeResponse{})
+		return
+	}
+
+	_, err := p.driver.Create(context.Background(), req.Name, driverName,
+		WithSize(req.Opts["size"]), WithPolicy(req.Opts["policy"]), WithLabels(req.Labels))
+	if err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, volumeResponse{})
+}
+
+func (p *pluginServer) get(w http.ResponseWriter, r *http.Request) {
+	var req volumeGetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, volumeGetResponse{Err: err.Error()})
+		return
+	}
+
+	p.countEvent(func(e *eventCounters) { e.Gets++ })
+	v, err := p.driver.Get(context.Background(), req.Name, WithReference(req.Reference))
+	if err != nil {
+		writeJSON(w, volumeGetResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, volumeGetResponse{Volume: &volumeInfo{Name: v.Name, Mountpoint: mountpointFor(v.Name)}})
+}
+
+func (p *pluginServer) list(w http.ResponseWriter, r *http.Request) {
+	p.countEvent(func(e *eventCounters) { e.Lists++ })
+	vols, warnings, err := p.driver.List(context.Background(), filters.Args{})
+	if err != nil {
+		writeJSON(w, volumeListResponse{Err: err.Error()})
+		return
+	}
+	resp := volumeListResponse{Volumes: make([]volumeInfo, 0, len(vols)), Warnings: warnings}
+	for _, v := range vols {
+		resp.Volumes = append(resp.Volumes, volumeInfo{Name: v.Name, Mountpoint: mountpointFor(v.Name)})
+	}
+	writeJSON(w, resp)
+}
+
+func (p *pluginServer) remove(w http.ResponseWriter, r *http.Request) {
+	var req volumeRemoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+
+	p.countEvent(func(e *eventCounters) { e.Removes++ })
+	if err := p.driver.Remove(context.Background(), req.Name,
+		WithForce(req.Force), WithPurgeOnError(req.PurgeOnError)); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, volumeResponse{})
+}
+
+func (p *pluginServer) path(w http.ResponseWriter, r *http.Request) {
+	var req volumeNameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, volumeResponse{Mountpoint: mountpointFor(req.Name)})
+}
+
+func (p *pluginServer) mount(w http.ResponseWriter, r *http.Request) {
+	var req volumeMountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+
+	p.countEvent(func(e *eventCounters) { e.Mounts++ })
+	mountpoint, err := p.driver.mount(req.Name)
+	if err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, volumeResponse{Mountpoint: mountpoint})
+}
+
+func (p *pluginServer) unmount(w http.ResponseWriter, r *http.Request) {
+	var req volumeMountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+
+	p.countEvent(func(e *eventCounters) { e.Unmounts++ })
+	if err := p.driver.unmount(req.Name); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, volumeResponse{})
+}
+
+func (p *pluginServer) capabilities(w http.ResponseWriter, r *http.Request) {
+	var resp capabilitiesResponse
+	resp.Capabilities.Scope = "global"
+	writeJSON(w, resp)
+}
+
+// writeSpecFile registers the plugin with Docker via the legacy
+// .spec file mechanism: a single line naming the address Docker
+// should dial.
+func writeSpecFile(addr string) error {
+	if err := os.MkdirAll("/etc/docker/plugins", 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pluginSpecPath, []byte(fmt.Sprintf("tcp://%s\n", addr)), 0644)
+}
+
+// listenUnix starts the plugin server on the well-known Unix socket
+// Docker polls for socket-activated (non-spec-file) plugin discovery.
+func listenUnix(handler http.Handler) (net.Listener, error) {
+	if err := os.MkdirAll(pluginSockDir, 0755); err != nil {
+		return nil, err
+	}
+	sockPath := pluginSockDir + "/" + pluginSockName
+	os.Remove(sockPath)
+
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(l, handler)
+	return l, nil
+}
@@ -5,6 +5,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/docker/engine-api/client"
@@ -12,13 +15,15 @@ import (
 	"github.com/docker/engine-api/types/container"
 	"github.com/docker/engine-api/types/filters"
 	"github.com/docker/engine-api/types/strslice"
+	"github.com/vikrantest/vsphere-storage-for-docker/cluster"
 	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
 const (
 	apiVersion           = "v1.22"
-	driverName           = "vmdk"
 	dockerUSocket        = "unix:///var/run/docker.sock"
 	defaultMountLocation = "/mnt/vol"
 )
@@ -126,6 +131,10 @@ func volumeVmdkExists(t *testing.T, c *client.Client, vol string) *types.Volume
 		t.Fatalf("Failed to enumerate  volumes: %v", err)
 	}
 
+	for _, w := range reply.Warnings {
+		t.Logf("VolumeList warning: %s", w)
+	}
+
 	for _, v := range reply.Volumes {
 		//	t.Log(v.Name, v.Driver, v.Mountpoint)
 		if v.Name == vol {
@@ -198,4 +207,420 @@ func TestSanity(t *testing.T) {
 				volumeName, elem.endPoint)
 		}
 	}
+}
+
+// posts a Docker Volume Plugin request and decodes a JSON response
+// into the given destination.
+func postPlugin(t *testing.T, url string, path string, req interface{}, dest interface{}) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("Failed to marshal %s request: %v", path, err)
+	}
+
+	resp, err := http.Post(url+path, pluginContentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(dest); err != nil {
+		t.Fatalf("Failed to decode %s response: %v", path, err)
+	}
+}
+
+// TestPluginSanity drives the Docker Volume Plugin HTTP server
+// directly, the way moby's docker_cli_external_volume_driver_test
+// drives a real plugin, and asserts the event counters it emits
+// match a single activate/create/mount/unmount/remove cycle.
+func TestPluginSanity(t *testing.T) {
+	p := newPluginServer(newVmdkDriver())
+	ts := httptest.NewServer(p.mux())
+	defer ts.Close()
+
+	var activateResp struct{ Implements []string }
+	postPlugin(t, ts.URL, "/Plugin.Activate", struct{}{}, &activateResp)
+
+	var createResp volumeResponse
+	postPlugin(t, ts.URL, "/VolumeDriver.Create",
+		volumeCreateRequest{Name: volumeName, Opts: map[string]string{"size": "1gb"}},
+		&createResp)
+	if createResp.Err != "" {
+		t.Fatalf("VolumeDriver.Create failed: %s", createResp.Err)
+	}
+
+	var mountResp volumeResponse
+	postPlugin(t, ts.URL, "/VolumeDriver.Mount",
+		volumeMountRequest{Name: volumeName, ID: "container1"}, &mountResp)
+	if mountResp.Err != "" {
+		t.Fatalf("VolumeDriver.Mount failed: %s", mountResp.Err)
+	}
+	if mountResp.Mountpoint != mountpointFor(volumeName) {
+		t.Fatalf("Unexpected mountpoint: got %s, want %s",
+			mountResp.Mountpoint, mountpointFor(volumeName))
+	}
+
+	var unmountResp volumeResponse
+	postPlugin(t, ts.URL, "/VolumeDriver.Unmount",
+		volumeMountRequest{Name: volumeName, ID: "container1"}, &unmountResp)
+	if unmountResp.Err != "" {
+		t.Fatalf("VolumeDriver.Unmount failed: %s", unmountResp.Err)
+	}
+
+	var removeResp volumeResponse
+	postPlugin(t, ts.URL, "/VolumeDriver.Remove",
+		volumeNameRequest{Name: volumeName}, &removeResp)
+	if removeResp.Err != "" {
+		t.Fatalf("VolumeDriver.Remove failed: %s", removeResp.Err)
+	}
+
+	want := eventCounters{Activations: 1, Creates: 1, Mounts: 1, Unmounts: 1, Removes: 1}
+	if p.events != want {
+		t.Fatalf("unexpected plugin event counts: got %+v, want %+v", p.events, want)
+	}
+}
+
+// connectEngines connects to both sanity-test endpoints and returns
+// them as a cluster.Engine slice.
+func connectEngines(t *testing.T) []cluster.Engine {
+	addrs := []string{endPoint1, endPoint2}
+	engines := make([]cluster.Engine, len(addrs))
+
+	for i, addr := range addrs {
+		c, err := client.NewClient(addr, apiVersion, nil, defaultHeaders)
+		if err != nil {
+			t.Fatalf("Failed to connect to %s, err: %v", addr, err)
+		}
+		engines[i] = cluster.Engine{Name: fmt.Sprintf("H%d", i+1), Client: c}
+	}
+	return engines
+}
+
+// TestClusterCreate exercises the clustered volume placement layer:
+// the create is fanned out to both engines in parallel via
+// cluster.CreateVolume, then a round-robin SelectHostForVolume
+// deterministically picks which engine's client performs the touch
+// and which performs the stat, instead of just hoping any host can
+// see the VMDK.
+func TestClusterCreate(t *testing.T) {
+	engines := connectEngines(t)
+	vol := volumeName + "-cluster"
+
+	_, err := cluster.CreateVolume(context.Background(), engines,
+		types.VolumeCreateRequest{
+			Name:   vol,
+			Driver: driverName,
+			DriverOpts: map[string]string{
+				"size":   "1gb",
+				"policy": "good",
+			},
+		})
+	if err != nil {
+		t.Fatalf("cluster.CreateVolume failed: %v", err)
+	}
+	defer engines[0].Client.VolumeRemove(vol)
+
+	var selector cluster.RoundRobin
+	touchHost, err := selector.Select(engines, types.VolumeCreateRequest{Name: vol})
+	if err != nil {
+		t.Fatalf("Select failed: %v", err)
+	}
+	statHost, err := selector.Select(engines, types.VolumeCreateRequest{Name: vol})
+	if err != nil {
+		t.Fatalf("Select failed: %v", err)
+	}
+
+	if code := runContainerCmd(t, touchHost.Client, vol, "busybox",
+		&strslice.StrSlice{"touch", getMountpoint(vol) + "/cluster_file"}, touchHost.Name); code != 0 {
+		t.Errorf("touch on %s: expected 0, got %d", touchHost.Name, code)
+	}
+	if code := runContainerCmd(t, statHost.Client, vol, "busybox",
+		&strslice.StrSlice{"stat", getMountpoint(vol) + "/cluster_file"}, statHost.Name); code != 0 {
+		t.Errorf("stat on %s: expected 0, got %d", statHost.Name, code)
+	}
+}
+
+// TestSnapshotRoundtrip exercises the snapshot/clone admin RPCs:
+// create a volume, write a file, snapshot it, delete the file, clone
+// from the snapshot into a new volume through a second plugin server
+// instance standing in for a second ESX host that shares the same
+// datastore, and confirm the file is present in the clone.
+func TestSnapshotRoundtrip(t *testing.T) {
+	backend := newVmdkDriver()
+	host1 := newPluginServer(backend)
+	host2 := newPluginServer(backend)
+
+	ts1 := httptest.NewServer(host1.mux())
+	defer ts1.Close()
+	ts2 := httptest.NewServer(host2.mux())
+	defer ts2.Close()
+
+	vol := volumeName + "-snap"
+	var createResp volumeResponse
+	postPlugin(t, ts1.URL, "/VolumeDriver.Create",
+		volumeCreateRequest{Name: vol, Opts: map[string]string{"size": "1gb"}}, &createResp)
+	if createResp.Err != "" {
+		t.Fatalf("VolumeDriver.Create failed: %s", createResp.Err)
+	}
+
+	if err := backend.writeFile(vol, "snapshot_test_file"); err != nil {
+		t.Fatalf("writeFile failed: %v", err)
+	}
+
+	var snapResp snapshotResponse
+	postPlugin(t, ts1.URL, "/VmdkVolumeDriver.SnapshotCreate",
+		snapshotCreateRequest{Name: vol, SnapshotName: "snap1"}, &snapResp)
+	if snapResp.Err != "" {
+		t.Fatalf("SnapshotCreate failed: %s", snapResp.Err)
+	}
+
+	if err := backend.deleteFile(vol, "snapshot_test_file"); err != nil {
+		t.Fatalf("deleteFile failed: %v", err)
+	}
+
+	clone := vol + "-clone"
+	var cloneResp volumeResponse
+	postPlugin(t, ts2.URL, "/VmdkVolumeDriver.CloneFromSnapshot",
+		cloneFromSnapshotRequest{SnapshotID: snapResp.Snapshot.ID, NewName: clone}, &cloneResp)
+	if cloneResp.Err != "" {
+		t.Fatalf("CloneFromSnapshot failed: %s", cloneResp.Err)
+	}
+
+	if !backend.hasFile(clone, "snapshot_test_file") {
+		t.Fatalf("expected clone %s to contain snapshot_test_file", clone)
+	}
+	if backend.hasFile(vol, "snapshot_test_file") {
+		t.Fatalf("expected original volume %s to no longer contain snapshot_test_file", vol)
+	}
+}
+
+// TestPrune exercises Backend.Prune: a label-filtered GC sweep that
+// removes only unmounted volumes matching the filter, leaving in-use
+// volumes and non-matching volumes untouched.
+func TestPrune(t *testing.T) {
+	backend := newVmdkDriver()
+	ctx := context.Background()
+
+	if _, err := backend.Create(ctx, "prune-keep", driverName,
+		WithLabels(map[string]string{"keep": "yes"})); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := backend.Create(ctx, "prune-drop", driverName,
+		WithLabels(map[string]string{"keep": "no"})); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := backend.Create(ctx, "prune-mounted", driverName,
+		WithLabels(map[string]string{"keep": "no"})); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := backend.mount("prune-mounted"); err != nil {
+		t.Fatalf("mount failed: %v", err)
+	}
+
+	filter := filters.NewArgs()
+	filter.Add("label", "keep=no")
+
+	report, err := backend.Prune(ctx, filter)
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if len(report.VolumesDeleted) != 1 || report.VolumesDeleted[0] != "prune-drop" {
+		t.Fatalf("unexpected prune report: %+v", report)
+	}
+
+	if _, err := backend.Get(ctx, "prune-keep"); err != nil {
+		t.Fatalf("expected prune-keep to survive prune: %v", err)
+	}
+	if _, err := backend.Get(ctx, "prune-mounted"); err != nil {
+		t.Fatalf("expected in-use prune-mounted to survive prune: %v", err)
+	}
+	if _, err := backend.Get(ctx, "prune-drop"); err == nil {
+		t.Fatalf("expected prune-drop to be removed")
+	}
+}
+
+// TestMountFailureNoPhantomUnmount forces a mount failure -- the
+// in-process analogue of `docker run -v foo:/bar busybox true`
+// failing because /bar doesn't exist, or failing on the image copy
+// with `-w /bar` -- and then asserts that a subsequent successful
+// mount still attaches cleanly, proving the earlier failure never
+// left a ref count for Docker's paired Unmount to mistakenly detach.
+func TestMountFailureNoPhantomUnmount(t *testing.T) {
+	backend := newVmdkDriver()
+	p := newPluginServer(backend)
+	ts := httptest.NewServer(p.mux())
+	defer ts.Close()
+
+	vol := volumeName + "-refcount"
+	var createResp volumeResponse
+	postPlugin(t, ts.URL, "/VolumeDriver.Create", volumeCreateRequest{Name: vol}, &createResp)
+	if createResp.Err != "" {
+		t.Fatalf("VolumeDriver.Create failed: %s", createResp.Err)
+	}
+
+	backend.simulateMountFailure(vol)
+
+	var failedMount volumeResponse
+	postPlugin(t, ts.URL, "/VolumeDriver.Mount",
+		volumeMountRequest{Name: vol, ID: "c1"}, &failedMount)
+	if failedMount.Err == "" {
+		t.Fatalf("expected simulated mount failure, got success")
+	}
+
+	// Docker still issues the paired Unmount after the container
+	// fails to start; it must not drive the ref count negative or
+	// trigger a detach for a mount that never actually happened.
+	var unmountResp volumeResponse
+	postPlugin(t, ts.URL, "/VolumeDriver.Unmount",
+		volumeMountRequest{Name: vol, ID: "c1"}, &unmountResp)
+	if unmountResp.Err != "" {
+		t.Fatalf("VolumeDriver.Unmount failed: %s", unmountResp.Err)
+	}
+	if count := backend.Stats()[vol]; count != 0 {
+		t.Fatalf("expected ref count 0 after failed mount + unmount, got %d", count)
+	}
+
+	// The retried `docker run` must still mount cleanly.
+	var mountResp volumeResponse
+	postPlugin(t, ts.URL, "/VolumeDriver.Mount",
+		volumeMountRequest{Name: vol, ID: "c2"}, &mountResp)
+	if mountResp.Err != "" {
+		t.Fatalf("VolumeDriver.Mount failed after prior failure: %s", mountResp.Err)
+	}
+	if count := backend.Stats()[vol]; count != 1 {
+		t.Fatalf("expected ref count 1 after successful mount, got %d", count)
+	}
+
+	postPlugin(t, ts.URL, "/VolumeDriver.Unmount",
+		volumeMountRequest{Name: vol, ID: "c2"}, &unmountResp)
+	if count := backend.Stats()[vol]; count != 0 {
+		t.Fatalf("expected ref count 0 after final unmount, got %d", count)
+	}
+}
+
+// TestRemoveInUseTypedError asserts that removing an in-use volume
+// returns an *ErrVolumeInUse a caller can match with errors.Is/As,
+// not just a bare string.
+func TestRemoveInUseTypedError(t *testing.T) {
+	backend := newVmdkDriver()
+	ctx := context.Background()
+
+	if _, err := backend.Create(ctx, "in-use-vol", driverName); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := backend.mount("in-use-vol"); err != nil {
+		t.Fatalf("mount failed: %v", err)
+	}
+
+	err := backend.Remove(ctx, "in-use-vol")
+	if !errors.Is(err, &ErrVolumeInUse{}) {
+		t.Fatalf("expected ErrVolumeInUse, got %v", err)
+	}
+
+	var inUse *ErrVolumeInUse
+	if !errors.As(err, &inUse) {
+		t.Fatalf("expected errors.As to extract *ErrVolumeInUse from %v", err)
+	}
+	if inUse.Name != "in-use-vol" {
+		t.Fatalf("expected ErrVolumeInUse.Name=in-use-vol, got %s", inUse.Name)
+	}
+
+	if err := backend.Remove(ctx, "no-such-vol"); !errors.Is(err, &ErrVolumeNotFound{}) {
+		t.Fatalf("expected ErrVolumeNotFound, got %v", err)
+	}
+
+	// WithForce overrides the in-use check so a caller can still tear
+	// down a volume Docker never got around to unmounting.
+	if err := backend.Remove(ctx, "in-use-vol", WithForce(true)); err != nil {
+		t.Fatalf("Remove with WithForce failed: %v", err)
+	}
+	if _, err := backend.Get(ctx, "in-use-vol"); !errors.Is(err, &ErrVolumeNotFound{}) {
+		t.Fatalf("expected in-use-vol to be gone after forced Remove, got %v", err)
+	}
+}
+
+// TestRemovePurgeOnError asserts that a Remove whose ESX RPC fails
+// (simulated here via an already-cancelled context) leaves the volume
+// behind by default, but WithPurgeOnError drops its metadata anyway.
+func TestRemovePurgeOnError(t *testing.T) {
+	backend := newVmdkDriver()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := backend.Create(context.Background(), "purge-vol", driverName); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	if err := backend.Remove(ctx, "purge-vol"); err == nil {
+		t.Fatalf("expected Remove to surface the cancelled-context esxCall error")
+	}
+	if _, err := backend.Get(context.Background(), "purge-vol"); err != nil {
+		t.Fatalf("expected purge-vol to survive a failed Remove, got %v", err)
+	}
+
+	if err := backend.Remove(ctx, "purge-vol", WithPurgeOnError(true)); err != nil {
+		t.Fatalf("Remove with WithPurgeOnError failed: %v", err)
+	}
+	if _, err := backend.Get(context.Background(), "purge-vol"); !errors.Is(err, &ErrVolumeNotFound{}) {
+		t.Fatalf("expected purge-vol to be gone after WithPurgeOnError, got %v", err)
+	}
+}
+
+// TestGetReference asserts that WithReference records the caller's
+// container reference on the volume, independent of refCounts.
+func TestGetReference(t *testing.T) {
+	backend := newVmdkDriver()
+	ctx := context.Background()
+
+	if _, err := backend.Create(ctx, "referenced-vol", driverName); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	v, err := backend.Get(ctx, "referenced-vol", WithReference("container1"))
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !v.References["container1"] {
+		t.Fatalf("expected Get(WithReference(\"container1\")) to record the reference")
+	}
+}
+
+// TestListWarnings asserts that listing across a datastore marked
+// unreachable yields a non-empty warning but still returns the
+// volumes backed by reachable datastores.
+func TestListWarnings(t *testing.T) {
+	backend := newVmdkDriver()
+	ctx := context.Background()
+
+	if _, err := backend.Create(ctx, "on-good-ds", driverName); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := backend.Create(ctx, "on-down-ds", driverName); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	backend.volumes["on-down-ds"].Datastore = "dsDown"
+	backend.markDatastoreUnreachable("dsDown")
+
+	vols, warnings, err := backend.List(ctx, filters.Args{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(warnings) == 0 {
+		t.Fatalf("expected a non-empty warning for the unreachable datastore")
+	}
+	if len(backend.LastWarnings()) != len(warnings) {
+		t.Fatalf("LastWarnings() did not reflect the most recent List call")
+	}
+
+	found := false
+	for _, v := range vols {
+		if v.Name == "on-down-ds" {
+			t.Fatalf("expected volume on the unreachable datastore to be dropped from List")
+		}
+		if v.Name == "on-good-ds" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected volume on the reachable datastore to still be listed")
+	}
 }
\ No newline at end of file
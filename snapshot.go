@@ -0,0 +1,299 @@
+//
+// Snapshot and clone support for VMDK volumes.
+//
+// Mirrors the OpenStack Cinder snapshot model: a snapshot is an
+// immutable point-in-time delta of its parent VMDK, stored alongside
+// it, and can only be taken while the parent is "available" (not
+// attached) -- unless the caller passes force=true, in which case the
+// volume is detached first and then snapshotted. These are admin
+// operations rather than part of the Docker Volume Plugin protocol,
+// so they are exposed as their own HTTP endpoints on the same plugin
+// server (see plugin.go).
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	statusAvailable = "available"
+	statusInUse     = "in-use"
+)
+
+// vmdkSnapshot is an immutable point-in-time copy of a vmdkVolume's
+// file contents.
+type vmdkSnapshot struct {
+	ID         string
+	Name       string
+	VolumeName string
+	Files      map[string]bool
+	Status     string
+}
+
+func (d *vmdkDriver) snapshotCreate(volName, snapName string, force bool) (*vmdkSnapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[volName]
+	if !exists {
+		return nil, errors.New("no such volume: " + volName)
+	}
+
+	if v.Status != statusAvailable {
+		if !force {
+			return nil, fmt.Errorf("volume %s is %s, not available (retry with force=true)", volName, v.Status)
+		}
+		// A volume can be mounted more than once (refCounts[volName] >
+		// 1); a single unmount only drops the count by one, so this
+		// must run the detach all the way to zero before the volume
+		// actually reaches "available".
+		for d.refCounts[volName] > 0 {
+			d.refCounts[volName]--
+		}
+		v.Mounted = false
+		v.Status = statusAvailable
+	}
+
+	d.snapshotSeq++
+	snap := &vmdkSnapshot{
+		ID:         fmt.Sprintf("snap-%d", d.snapshotSeq),
+		Name:       snapName,
+		VolumeName: volName,
+		Files:      copyFiles(v.Files),
+		Status:     statusAvailable,
+	}
+	d.snapshots[snap.ID] = snap
+	return snap, nil
+}
+
+func (d *vmdkDriver) snapshotList(volName string) []*vmdkSnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var snaps []*vmdkSnapshot
+	for _, s := range d.snapshots {
+		if s.VolumeName == volName {
+			snaps = append(snaps, s)
+		}
+	}
+	return snaps
+}
+
+func (d *vmdkDriver) snapshotDelete(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.snapshots[id]; !exists {
+		return errors.New("no such snapshot: " + id)
+	}
+	delete(d.snapshots, id)
+	return nil
+}
+
+func (d *vmdkDriver) cloneFromSnapshot(snapID, newName string) (*vmdkVolume, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	snap, exists := d.snapshots[snapID]
+	if !exists {
+		return nil, errors.New("no such snapshot: " + snapID)
+	}
+	return d.cloneInto(newName, snap.Files)
+}
+
+// cloneFromSnapshotByName resolves a snapshot by name, as used by the
+// "from-snapshot" DriverOpt on VolumeDriver.Create, then clones it
+// the same way cloneFromSnapshot does.
+func (d *vmdkDriver) cloneFromSnapshotByName(snapName, newName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, s := range d.snapshots {
+		if s.Name == snapName {
+			_, err := d.cloneInto(newName, s.Files)
+			return err
+		}
+	}
+	return errors.New("no such snapshot: " + snapName)
+}
+
+// cloneVolume clones volName's current contents directly, as used by
+// the "clone-of" DriverOpt on VolumeDriver.Create.
+func (d *vmdkDriver) cloneVolume(volName, newName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[volName]
+	if !exists {
+		return errors.New("no such volume: " + volName)
+	}
+	_, err := d.cloneInto(newName, v.Files)
+	return err
+}
+
+// cloneInto assumes the caller already holds d.mu.
+func (d *vmdkDriver) cloneInto(newName string, files map[string]bool) (*vmdkVolume, error) {
+	if _, exists := d.volumes[newName]; exists {
+		return nil, errors.New("volume already exists: " + newName)
+	}
+	v := &vmdkVolume{
+		Name:       newName,
+		Status:     statusAvailable,
+		Files:      copyFiles(files),
+		References: make(map[string]bool),
+	}
+	d.volumes[newName] = v
+	return v, nil
+}
+
+func copyFiles(files map[string]bool) map[string]bool {
+	out := make(map[string]bool, len(files))
+	for f := range files {
+		out[f] = true
+	}
+	return out
+}
+
+// waitForStatusPollInterval is the delay between status checks in
+// waitForStatus, so a caller blocked on a real ESX-backed operation
+// polls instead of spinning a CPU core.
+const waitForStatusPollInterval = 10 * time.Millisecond
+
+// waitForStatus blocks until volName reaches status, or returns an
+// error once timeout elapses. The in-memory backend applies every
+// state change synchronously, so this returns on the first check in
+// practice; real ESX-backed operations are asynchronous and need the
+// polling loop.
+func (d *vmdkDriver) waitForStatus(volName, status string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		d.mu.Lock()
+		v, exists := d.volumes[volName]
+		if !exists {
+			d.mu.Unlock()
+			return errors.New("no such volume: " + volName)
+		}
+		reached := v.Status == status
+		d.mu.Unlock()
+
+		if reached {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for volume %s to reach status %s", volName, status)
+		}
+		time.Sleep(waitForStatusPollInterval)
+	}
+}
+
+// snapshotCreateRequest is the {Name, SnapshotName, Force} payload
+// VmdkVolumeDriver.SnapshotCreate accepts.
+type snapshotCreateRequest struct {
+	Name         string // volume name
+	SnapshotName string
+	Force        bool
+}
+
+type snapshotInfo struct {
+	ID     string
+	Name   string
+	Status string
+}
+
+type snapshotResponse struct {
+	Snapshot *snapshotInfo `json:",omitempty"`
+	Err      string
+}
+
+type snapshotListRequest struct {
+	Name string // volume name
+}
+
+type snapshotListResponse struct {
+	Snapshots []snapshotInfo
+	Err       string
+}
+
+type snapshotDeleteRequest struct {
+	ID string
+}
+
+type cloneFromSnapshotRequest struct {
+	SnapshotID string
+	NewName    string
+}
+
+// snapshotSettleTimeout bounds how long SnapshotCreate waits for its
+// source volume to settle back to "available" after a forced detach,
+// the way a caller would want to wait for ESX to finish the
+// corresponding real detach before reporting success.
+const snapshotSettleTimeout = 5 * time.Second
+
+func (p *pluginServer) snapshotCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var req snapshotCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, snapshotResponse{Err: err.Error()})
+		return
+	}
+
+	snap, err := p.driver.snapshotCreate(req.Name, req.SnapshotName, req.Force)
+	if err != nil {
+		writeJSON(w, snapshotResponse{Err: err.Error()})
+		return
+	}
+	if req.Force {
+		if err := p.driver.waitForStatus(req.Name, statusAvailable, snapshotSettleTimeout); err != nil {
+			writeJSON(w, snapshotResponse{Err: err.Error()})
+			return
+		}
+	}
+	writeJSON(w, snapshotResponse{Snapshot: &snapshotInfo{ID: snap.ID, Name: snap.Name, Status: snap.Status}})
+}
+
+func (p *pluginServer) snapshotListHandler(w http.ResponseWriter, r *http.Request) {
+	var req snapshotListRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, snapshotListResponse{Err: err.Error()})
+		return
+	}
+
+	snaps := p.driver.snapshotList(req.Name)
+	resp := snapshotListResponse{Snapshots: make([]snapshotInfo, 0, len(snaps))}
+	for _, s := range snaps {
+		resp.Snapshots = append(resp.Snapshots, snapshotInfo{ID: s.ID, Name: s.Name, Status: s.Status})
+	}
+	writeJSON(w, resp)
+}
+
+func (p *pluginServer) snapshotDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var req snapshotDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+
+	if err := p.driver.snapshotDelete(req.ID); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, volumeResponse{})
+}
+
+func (p *pluginServer) cloneFromSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var req cloneFromSnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+
+	if _, err := p.driver.cloneFromSnapshot(req.SnapshotID, req.NewName); err != nil {
+		writeJSON(w, volumeResponse{Err: err.Error()})
+		return
+	}
+	writeJSON(w, volumeResponse{})
+}